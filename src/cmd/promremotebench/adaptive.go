@@ -0,0 +1,318 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// ewmaDecay is the smoothing factor applied on every sample, mirroring
+// the decay used by Prometheus's remote-write queue manager to track
+// per-shard send latency.
+const ewmaDecay = 0.2
+
+// defaultTargetQPS is used when AdaptiveConcurrency is enabled without
+// an explicit TargetQPS, so the limiter never silently collapses to
+// rate.NewLimiter(0, 1) (one request ever, then blocked forever).
+const defaultTargetQPS = 1.0
+
+// urlEWMA tracks a decaying average of request latency and error rate
+// for a single URL, used to scale concurrency up or down.
+type urlEWMA struct {
+	mu        sync.Mutex
+	latency   time.Duration
+	errorRate float64
+	samples   int
+}
+
+// Observe folds a single request's outcome into the EWMA.
+func (u *urlEWMA) Observe(latency time.Duration, isErr bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	errSample := 0.0
+	if isErr {
+		errSample = 1.0
+	}
+
+	if u.samples == 0 {
+		u.latency = latency
+		u.errorRate = errSample
+	} else {
+		u.latency = time.Duration(float64(latency)*ewmaDecay + float64(u.latency)*(1-ewmaDecay))
+		u.errorRate = errSample*ewmaDecay + u.errorRate*(1-ewmaDecay)
+	}
+	u.samples++
+}
+
+// Snapshot returns the current latency and error rate EWMAs.
+func (u *urlEWMA) Snapshot() (time.Duration, float64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.latency, u.errorRate
+}
+
+// adaptiveConcurrencyOptions configures the token-bucket rate limit and
+// EWMA-driven shard scaling applied to alertLoad's query pool, in the
+// same spirit as the Prometheus remote-write queue manager scaling its
+// per-URL shard count off of observed send latency.
+type adaptiveConcurrencyOptions struct {
+	// TargetQPS caps the aggregate rate of queries issued, across all
+	// shards, via a token-bucket limiter.
+	TargetQPS float64
+	// MaxInFlight is the maximum number of concurrent in-flight shards
+	// per URL; scaling never grows past this ceiling.
+	MaxInFlight int
+	// LatencyThreshold is the EWMA latency above which a URL's shard
+	// count is scaled down instead of up.
+	LatencyThreshold time.Duration
+	// ErrorRateThreshold is the EWMA error rate above which a URL's
+	// shard count is scaled down instead of up. A request counts as an
+	// error only when executeQuery returns an error (it could not be
+	// built or sent, or its body could not be read); non-2XX responses
+	// are logged by executeQuery but are not counted as errors.
+	ErrorRateThreshold float64
+	// RescaleInterval is how often each URL's shard count is
+	// reconsidered.
+	RescaleInterval time.Duration
+	// MetricsAddr, if set, serves a Prometheus /metrics handler
+	// exposing per-URL in-flight, shard count, EWMA latency and
+	// success/error counters for the load the executor is generating.
+	MetricsAddr string
+}
+
+// loadMetrics are the Prometheus metrics describing promremotebench's
+// own query load-shaping behavior, so a run's adaptive concurrency can
+// be observed the same way any other service's would be.
+type loadMetrics struct {
+	inFlight *prometheus.GaugeVec
+	shards   *prometheus.GaugeVec
+	latency  *prometheus.GaugeVec
+	requests *prometheus.CounterVec
+}
+
+func newLoadMetrics() *loadMetrics {
+	m := &loadMetrics{
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "promremotebench_query_in_flight",
+			Help: "Current number of in-flight query requests per URL.",
+		}, []string{"url"}),
+		shards: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "promremotebench_query_shards",
+			Help: "Current number of concurrent query shards per URL.",
+		}, []string{"url"}),
+		latency: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "promremotebench_query_latency_ewma_seconds",
+			Help: "EWMA of observed query latency per URL, in seconds.",
+		}, []string{"url"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promremotebench_query_requests_total",
+			Help: "Total number of query requests issued per URL, by outcome.",
+		}, []string{"url", "outcome"}),
+	}
+
+	prometheus.MustRegister(m.inFlight, m.shards, m.latency, m.requests)
+	return m
+}
+
+// Serve starts an HTTP server exposing the registered metrics at
+// /metrics, blocking until it exits.
+func (m *loadMetrics) Serve(addr string, logger *zap.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	logger.Info("serving query load metrics", zap.String("addr", addr))
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Error("metrics server exited", zap.Error(err))
+	}
+}
+
+// adaptiveQueryLoad replaces queryExecutor.alertLoad's fixed goroutine
+// pool with one shard goroutine per URL whose count is scaled up or
+// down based on that URL's observed latency/error-rate EWMA, all
+// sharing a single token-bucket limiter so the aggregate rate across
+// every URL never exceeds TargetQPS.
+type adaptiveQueryLoad struct {
+	*queryExecutor
+	adaptiveConcurrencyOptions
+
+	limiter *rate.Limiter
+	metrics *loadMetrics
+	ewma    map[string]*urlEWMA
+	shards  map[string]*int32
+}
+
+func newAdaptiveQueryLoad(
+	executor *queryExecutor,
+	opts adaptiveConcurrencyOptions,
+) *adaptiveQueryLoad {
+	ewma := make(map[string]*urlEWMA, len(executor.URLs))
+	shards := make(map[string]*int32, len(executor.URLs))
+	for _, url := range executor.URLs {
+		ewma[url] = &urlEWMA{}
+		var n int32 = 1
+		shards[url] = &n
+	}
+
+	if opts.RescaleInterval <= 0 {
+		opts.RescaleInterval = 10 * time.Second
+	}
+	if opts.MaxInFlight <= 0 {
+		opts.MaxInFlight = 1
+	}
+	if opts.TargetQPS <= 0 {
+		executor.Logger.Warn("adaptive concurrency configured without a positive TargetQPS, defaulting",
+			zap.Float64("default_target_qps", defaultTargetQPS))
+		opts.TargetQPS = defaultTargetQPS
+	}
+
+	burst := int(opts.TargetQPS)
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &adaptiveQueryLoad{
+		queryExecutor:              executor,
+		adaptiveConcurrencyOptions: opts,
+		limiter:                    rate.NewLimiter(rate.Limit(opts.TargetQPS), burst),
+		metrics:                    newLoadMetrics(),
+		ewma:                       ewma,
+		shards:                     shards,
+	}
+}
+
+// Run starts the per-URL shard scaler and the metrics server, then
+// launches the initial shard for every URL.
+func (a *adaptiveQueryLoad) Run(checker Checker) {
+	if a.MetricsAddr != "" {
+		go a.metrics.Serve(a.MetricsAddr, a.Logger)
+	}
+
+	for _, url := range a.URLs {
+		go a.rescaleLoop(url, checker)
+		go a.runShard(url, checker)
+	}
+}
+
+// rescaleLoop periodically compares a URL's EWMA latency and error
+// rate against the configured thresholds, starting another shard
+// goroutine when both are healthy and capacity remains, and letting a
+// shard goroutine exit (via the shards counter) when either is not.
+func (a *adaptiveQueryLoad) rescaleLoop(url string, checker Checker) {
+	ticker := time.NewTicker(a.RescaleInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		latency, errorRate := a.ewma[url].Snapshot()
+		current := atomic.LoadInt32(a.shards[url])
+		a.metrics.latency.WithLabelValues(url).Set(latency.Seconds())
+		a.metrics.shards.WithLabelValues(url).Set(float64(current))
+
+		healthy := latency < a.LatencyThreshold && errorRate < a.ErrorRateThreshold
+		switch {
+		case healthy && int(current) < a.MaxInFlight:
+			atomic.AddInt32(a.shards[url], 1)
+			go a.runShard(url, checker)
+		case !healthy && current > 1:
+			atomic.AddInt32(a.shards[url], -1)
+		}
+	}
+}
+
+// runShard runs a single shard's query loop for url until the shard
+// count is scaled back below its own ordinal, at which point it exits.
+func (a *adaptiveQueryLoad) runShard(url string, checker Checker) {
+	ordinal := atomic.LoadInt32(a.shards[url])
+
+	for i := 0; ; i++ {
+		if atomic.LoadInt32(a.shards[url]) < ordinal {
+			return
+		}
+
+		if i > 0 {
+			time.Sleep(a.Sleep)
+		}
+
+		if err := a.limiter.Wait(context.Background()); err != nil {
+			return
+		}
+
+		a.metrics.inFlight.WithLabelValues(url).Inc()
+		start := time.Now()
+		_, err := a.singleURLQuery(url, checker)
+		latency := time.Since(start)
+		a.metrics.inFlight.WithLabelValues(url).Dec()
+
+		a.ewma[url].Observe(latency, err != nil)
+		outcome := "success"
+		if err != nil {
+			outcome = "error"
+		}
+		a.metrics.requests.WithLabelValues(url, outcome).Inc()
+	}
+}
+
+// singleURLQuery builds a query the same way alertLoad does - picking a
+// tenant, applying its label overrides via labelsFor, and selecting
+// among the configured WorkloadProfiles (falling back to the default
+// hostname alternation profile) - but issues it against a single URL
+// rather than fanning out to every configured endpoint, since each
+// shard here is already scoped to one URL by the per-URL rescale loop.
+func (a *adaptiveQueryLoad) singleURLQuery(targetURL string, checker Checker) ([]byte, error) {
+	curHostnames := checker.GetHostNames()
+	if len(curHostnames) == 0 {
+		return nil, nil
+	}
+
+	tenant := a.pickTenant()
+	labels := a.labelsFor(tenant)
+	labelMap := make(map[string]string, len(labels))
+	for _, l := range labels {
+		labelMap[l.name] = l.value
+	}
+
+	profiles := a.workloadProfiles()
+	profile := profiles[rand.Intn(len(profiles))]
+	queryStr, _, queryRange, queryStep := profile.BuildQuery(curHostnames, labelMap)
+
+	now := time.Now()
+	values := make(url.Values)
+	values.Set("query", queryStr)
+	values.Set("start", strconv.Itoa(int(now.Add(-1*queryRange).Unix())))
+	values.Set("end", strconv.Itoa(int(now.Unix())))
+	values.Set("step", queryStep.String())
+
+	reqURL := fmt.Sprintf("%s?%s", targetURL, values.Encode())
+	return a.executeQuery(reqURL, false, tenant)
+}
@@ -0,0 +1,376 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+
+	xerrors "github.com/m3db/m3/src/x/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// grpcQueryExecutorOptions configures a grpcQueryExecutor.
+type grpcQueryExecutorOptions struct {
+	queryExecutorOptions
+
+	// URLs are the Thanos-style gRPC StoreAPI/Query endpoints to fan
+	// out to, e.g. "thanos-query:10901".
+	URLs []string
+	// TLSEnabled, if set, dials endpoints over TLS using the system
+	// cert pool; otherwise connections are made insecurely.
+	TLSEnabled bool
+	// PartialResponseStrategy is sent with every request and controls
+	// how a queried StoreAPI should behave when a subset of stores
+	// fail to respond in time.
+	PartialResponseStrategy storepb.PartialResponseStrategy
+}
+
+// grpcQueryExecutor fans StoreAPI.Series and Query/QueryRange gRPC
+// requests out to a set of Thanos-style endpoints in parallel with the
+// HTTP PromQL path driven by queryExecutor, keeping each endpoint's
+// results separate so they can be cross-validated against each other
+// the same way queryExecutor's HTTP fanout is.
+type grpcQueryExecutor struct {
+	grpcQueryExecutorOptions
+
+	conns []*grpc.ClientConn
+}
+
+func newGRPCQueryExecutor(opts grpcQueryExecutorOptions) (*grpcQueryExecutor, error) {
+	dialOpts := []grpc.DialOption{grpc.WithBlock()}
+	if opts.TLSEnabled {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(nil)))
+	} else {
+		dialOpts = append(dialOpts, grpc.WithInsecure())
+	}
+
+	conns := make([]*grpc.ClientConn, 0, len(opts.URLs))
+	for _, url := range opts.URLs {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		conn, err := grpc.DialContext(ctx, url, dialOpts...)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial grpc endpoint %s: %v", url, err)
+		}
+		conns = append(conns, conn)
+	}
+
+	return &grpcQueryExecutor{
+		grpcQueryExecutorOptions: opts,
+		conns:                    conns,
+	}, nil
+}
+
+// Run starts the gRPC load and accuracy goroutines.
+func (q *grpcQueryExecutor) Run(checker Checker) {
+	if len(q.conns) == 0 {
+		return
+	}
+
+	q.Logger.Info("grpc query load configured",
+		zap.Int("concurrency", q.Concurrency),
+		zap.Strings("urls", q.URLs))
+	for i := 0; i < q.Concurrency; i++ {
+		go q.alertLoad(checker)
+	}
+}
+
+// alertLoad picks one random host from the checker on every round and
+// issues a StoreAPI.Series RPC matching that hostname plus the common
+// labels (for raw series fanout), and a Query/QueryRange RPC for the
+// bare hostname selector (without the common labels), against every
+// configured gRPC endpoint.
+func (q *grpcQueryExecutor) alertLoad(checker Checker) {
+	for i := 0; ; i++ {
+		func() {
+			if i > 0 {
+				time.Sleep(q.Sleep)
+			}
+
+			curHostnames := checker.GetHostNames()
+			if len(curHostnames) == 0 {
+				q.Logger.Error("no hosts returned in the checker, skipping grpc load round")
+				return
+			}
+
+			host := curHostnames[rand.Intn(len(curHostnames))]
+			matchers := []storepb.LabelMatcher{
+				{Type: storepb.LabelMatcher_EQ, Name: "hostname", Value: host},
+			}
+			for k, v := range q.Labels {
+				matchers = append(matchers, storepb.LabelMatcher{
+					Type: storepb.LabelMatcher_EQ, Name: k, Value: v,
+				})
+			}
+
+			now := time.Now()
+			start := now.Add(-1 * q.LoadRange).Unix() * 1000
+			end := now.Unix() * 1000
+
+			if results, err := q.fanoutSeries(matchers, start, end); err != nil {
+				q.Logger.Error("grpc series fanout failed", zap.Error(err))
+			} else {
+				q.validateSeriesAcrossEndpoints(results)
+			}
+
+			query := fmt.Sprintf("hostname=\"%s\"", host)
+			if results, err := q.fanoutQueryRange(query, start, end); err != nil {
+				q.Logger.Error("grpc query_range fanout failed", zap.Error(err))
+			} else {
+				q.validateQueryRangeAcrossEndpoints(results)
+			}
+		}()
+	}
+}
+
+// fanoutSeries issues a StoreAPI.Series streaming RPC against every
+// configured endpoint, one after another, returning each endpoint's series
+// separately so the caller can check that every endpoint returned the
+// same set of series.
+func (q *grpcQueryExecutor) fanoutSeries(
+	matchers []storepb.LabelMatcher,
+	startMs, endMs int64,
+) ([][]storepb.Series, error) {
+	req := &storepb.SeriesRequest{
+		MinTime:                 startMs,
+		MaxTime:                 endMs,
+		Matchers:                matchers,
+		PartialResponseStrategy: q.PartialResponseStrategy,
+	}
+
+	var multiErr xerrors.MultiError
+	results := make([][]storepb.Series, 0, len(q.conns))
+	for _, conn := range q.conns {
+		series, err := q.collectSeries(conn, req)
+		if err != nil {
+			multiErr = multiErr.Add(err)
+			continue
+		}
+		results = append(results, series)
+	}
+
+	if err := multiErr.FinalError(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func (q *grpcQueryExecutor) collectSeries(
+	conn *grpc.ClientConn,
+	req *storepb.SeriesRequest,
+) ([]storepb.Series, error) {
+	client := storepb.NewStoreClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), q.LoadRange)
+	defer cancel()
+
+	stream, err := client.Series(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start series stream: %v", err)
+	}
+
+	var series []storepb.Series
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("series stream error: %v", err)
+		}
+
+		if s := resp.GetSeries(); s != nil {
+			series = append(series, *s)
+		}
+	}
+
+	return series, nil
+}
+
+// seriesKey returns the canonical label-set signature of a single
+// StoreAPI series, independent of the order its labels were returned
+// in.
+func seriesKey(s storepb.Series) string {
+	names := make([]string, 0, len(s.Labels))
+	for _, l := range s.Labels {
+		names = append(names, l.Name+"="+l.Value)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// validateSeriesAcrossEndpoints checks that every endpoint's Series RPC
+// response (results[1:]) contains exactly the same set of series,
+// keyed by label identity, as the reference endpoint (results[0]),
+// logging an error for every series present on only one side.
+func (q *grpcQueryExecutor) validateSeriesAcrossEndpoints(results [][]storepb.Series) {
+	if len(results) < 2 {
+		return
+	}
+
+	first := make(map[string]struct{}, len(results[0]))
+	for _, s := range results[0] {
+		first[seriesKey(s)] = struct{}{}
+	}
+
+	for i, series := range results[1:] {
+		other := make(map[string]struct{}, len(series))
+		for _, s := range series {
+			other[seriesKey(s)] = struct{}{}
+		}
+
+		for key := range first {
+			if _, ok := other[key]; !ok {
+				q.Logger.Error("grpc series fanout mismatch: series missing from endpoint",
+					zap.Int("endpoint", i+1), zap.String("series", key))
+			}
+		}
+		for key := range other {
+			if _, ok := first[key]; !ok {
+				q.Logger.Error("grpc series fanout mismatch: unexpected series from endpoint",
+					zap.Int("endpoint", i+1), zap.String("series", key))
+			}
+		}
+	}
+}
+
+// fanoutQueryRange issues the newer Query/QueryRange gRPC RPC against
+// every configured endpoint, normalizing each endpoint's response into
+// PromQueryMatrix and keeping endpoints separate so the caller can
+// cross-validate them the same way as the HTTP PromQL path.
+func (q *grpcQueryExecutor) fanoutQueryRange(
+	query string,
+	startMs, endMs int64,
+) ([][]PromQueryMatrix, error) {
+	req := &storepb.QueryRangeRequest{
+		Query:                   query,
+		StartTimeSeconds:        startMs / 1000,
+		EndTimeSeconds:          endMs / 1000,
+		IntervalSeconds:         int64(q.LoadStep.Seconds()),
+		PartialResponseStrategy: q.PartialResponseStrategy,
+	}
+
+	var (
+		multiErr xerrors.MultiError
+		results  [][]PromQueryMatrix
+	)
+	for _, conn := range q.conns {
+		matrix, err := q.queryRange(conn, req)
+		if err != nil {
+			multiErr = multiErr.Add(err)
+			continue
+		}
+		results = append(results, matrix)
+	}
+
+	if err := multiErr.FinalError(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// validateQueryRangeAcrossEndpoints canonicalizes every endpoint's
+// matrices by label identity and compares them against the reference
+// endpoint's (results[0]) within the configured float tolerance, the
+// same canonicalize-then-compare approach queryExecutor.diffQueryResults
+// uses for the HTTP PromQL path.
+func (q *grpcQueryExecutor) validateQueryRangeAcrossEndpoints(results [][]PromQueryMatrix) {
+	if len(results) < 2 {
+		return
+	}
+
+	first := canonicalizeSeries(results[0])
+	for i, matrices := range results[1:] {
+		other := canonicalizeSeries(matrices)
+
+		for key, firstMatrix := range first {
+			otherMatrix, ok := other[key]
+			if !ok {
+				q.Logger.Error("grpc query_range fanout mismatch: series missing from endpoint",
+					zap.Int("endpoint", i+1), zap.String("series", key))
+				continue
+			}
+
+			if deltas := q.compareValues(key, firstMatrix.Values, otherMatrix.Values); len(deltas) > 0 {
+				q.Logger.Error("grpc query_range fanout mismatch: values diverged",
+					zap.Int("endpoint", i+1), zap.String("series", key), zap.Int("num_deltas", len(deltas)))
+			}
+		}
+	}
+}
+
+func (q *grpcQueryExecutor) queryRange(
+	conn *grpc.ClientConn,
+	req *storepb.QueryRangeRequest,
+) ([]PromQueryMatrix, error) {
+	client := storepb.NewQueryClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), q.LoadRange)
+	defer cancel()
+
+	stream, err := client.QueryRange(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start query_range: %v", err)
+	}
+
+	var matrices []PromQueryMatrix
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("query_range stream error: %v", err)
+		}
+
+		ts := resp.GetTimeseries()
+		if ts == nil {
+			continue
+		}
+
+		metric := make(model.Metric, len(ts.Labels))
+		for _, l := range ts.Labels {
+			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		}
+
+		values := make([]model.SamplePair, 0, len(ts.Samples))
+		for _, s := range ts.Samples {
+			values = append(values, model.SamplePair{
+				Timestamp: model.Time(s.Timestamp),
+				Value:     model.SampleValue(s.Value),
+			})
+		}
+		matrices = append(matrices, PromQueryMatrix{Metric: metric, Values: values})
+	}
+
+	return matrices, nil
+}
@@ -0,0 +1,416 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"go.uber.org/zap"
+)
+
+// nativeHistogramSchema is the bucket resolution schema used for every
+// generated histogram; schema 3 gives a reasonable number of buckets
+// per decade without generating excessive series cardinality.
+const nativeHistogramSchema = 3
+
+// histogramGroundTruth is the ground truth recorded for the most
+// recently generated histogram for a single host, kept so that
+// validateHistogramQuery can compare a query result against exactly
+// what was written rather than recomputing it from raw samples.
+type histogramGroundTruth struct {
+	count          uint64
+	sum            float64
+	zeroThreshold  float64
+	zeroCount      uint64
+	positiveSpans  []prompb.BucketSpan
+	positiveCounts []float64 // per-bucket (non-cumulative) counts, one per positive span bucket
+	negativeSpans  []prompb.BucketSpan
+	negativeCounts []float64
+}
+
+// nativeHistogramGenerator generates Prometheus native (sparse)
+// histogram samples for remote_write, recording the ground truth for
+// each host so it can later be cross-validated against query results.
+type nativeHistogramGenerator struct {
+	mu     sync.Mutex
+	truth  map[string]histogramGroundTruth
+	Logger *zap.Logger
+}
+
+func newNativeHistogramGenerator(logger *zap.Logger) *nativeHistogramGenerator {
+	return &nativeHistogramGenerator{
+		truth:  make(map[string]histogramGroundTruth),
+		Logger: logger,
+	}
+}
+
+// Generate builds a prompb.Histogram sample for a host at ts, drawing
+// the count of each of its 16 positive buckets uniformly from 0-9, and
+// records the resulting ground truth for that host.
+func (g *nativeHistogramGenerator) Generate(host string, ts time.Time) prompb.Histogram {
+	const numPositiveBuckets = 16
+
+	spans := []prompb.BucketSpan{{Offset: 0, Length: numPositiveBuckets}}
+	deltas := make([]int64, numPositiveBuckets)
+	counts := make([]float64, numPositiveBuckets)
+
+	var (
+		count uint64
+		sum   float64
+		prev  int64
+	)
+	for i := 0; i < numPositiveBuckets; i++ {
+		bucketCount := int64(rand.Intn(10))
+		deltas[i] = bucketCount - prev
+		prev = bucketCount
+
+		counts[i] = float64(bucketCount)
+		count += uint64(bucketCount)
+		sum += float64(bucketCount) * observationValue(i)
+	}
+
+	truth := histogramGroundTruth{
+		count:          count,
+		sum:            sum,
+		zeroThreshold:  0.001,
+		zeroCount:      0,
+		positiveSpans:  spans,
+		positiveCounts: counts,
+	}
+
+	g.mu.Lock()
+	g.truth[host] = truth
+	g.mu.Unlock()
+
+	return prompb.Histogram{
+		Count:          &prompb.Histogram_CountInt{CountInt: count},
+		Sum:            sum,
+		Schema:         nativeHistogramSchema,
+		ZeroThreshold:  truth.zeroThreshold,
+		ZeroCount:      &prompb.Histogram_ZeroCountInt{ZeroCountInt: truth.zeroCount},
+		PositiveSpans:  spans,
+		PositiveDeltas: deltas,
+		Timestamp:      ts.UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// GroundTruth returns the last generated histogram for host, if any.
+func (g *nativeHistogramGenerator) GroundTruth(host string) (histogramGroundTruth, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	truth, ok := g.truth[host]
+	return truth, ok
+}
+
+// numPositiveBucketsPerUnit is the number of native histogram buckets
+// per power-of-two under schema 3, used to derive a representative
+// observation value for each bucket when computing the ground-truth sum.
+const numPositiveBucketsPerUnit = 8
+
+// observationValue maps a bucket index to the representative
+// observation value used when computing the ground-truth sum; it
+// mirrors the exponential bucket boundaries schema 3 produces.
+func observationValue(bucketIndex int) float64 {
+	return math.Pow(2, float64(bucketIndex+1)/float64(numPositiveBucketsPerUnit))
+}
+
+// PromQueryHistogram is the JSON shape Prometheus uses for a native
+// histogram value within a matrix result.
+type PromQueryHistogram struct {
+	Count   string          `json:"count"`
+	Sum     string          `json:"sum"`
+	Buckets [][]interface{} `json:"buckets"`
+}
+
+// PromQueryHistogramPair pairs a timestamp with a PromQueryHistogram,
+// matching Prometheus's `[ <unix_time>, { ...histogram... } ]` encoding
+// for a single sample in a native histogram range query result.
+type PromQueryHistogramPair struct {
+	Timestamp float64
+	Histogram PromQueryHistogram
+}
+
+// UnmarshalJSON decodes the two-element `[ timestamp, histogram ]` form
+// Prometheus returns for native histogram samples.
+func (p *PromQueryHistogramPair) UnmarshalJSON(data []byte) error {
+	var raw [2]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(raw[0], &p.Timestamp); err != nil {
+		return fmt.Errorf("failed to decode histogram sample timestamp: %v", err)
+	}
+
+	if err := json.Unmarshal(raw[1], &p.Histogram); err != nil {
+		return fmt.Errorf("failed to decode histogram sample value: %v", err)
+	}
+
+	return nil
+}
+
+// histogramQueryExecutor re-queries the native histogram series written
+// for each host against the configured URLs and cross-validates the
+// decoded histogram values against the ground truth recorded by a
+// nativeHistogramGenerator at write time.
+type histogramQueryExecutor struct {
+	queryExecutorOptions
+	generator *nativeHistogramGenerator
+}
+
+func newHistogramQueryExecutor(
+	opts queryExecutorOptions,
+	generator *nativeHistogramGenerator,
+) *histogramQueryExecutor {
+	return &histogramQueryExecutor{
+		queryExecutorOptions: opts,
+		generator:            generator,
+	}
+}
+
+// histogramQueryTemplates are the PromQL templates exercised against
+// the native histogram series, keyed by name for logging. The ground
+// truth nativeHistogramGenerator records is the raw histogram sample
+// written for a host, re-randomized (not accumulated) on every write,
+// so only a template that returns that native histogram value
+// unmodified is comparable against it - histogram_quantile() and
+// histogram_sum() return plain floats, and rate() assumes a monotonic
+// counter, none of which this ground truth satisfies.
+var histogramQueryTemplates = []struct {
+	name  string
+	query string
+}{
+	{name: "raw", query: "%s"},
+}
+
+// Run starts the histogram load goroutines.
+func (q *histogramQueryExecutor) Run(checker Checker) {
+	if q.generator == nil {
+		return
+	}
+
+	q.Logger.Info("native histogram query load configured",
+		zap.Int("concurrency", q.Concurrency))
+	for i := 0; i < q.Concurrency; i++ {
+		go q.alertLoad(checker)
+	}
+}
+
+func (q *histogramQueryExecutor) alertLoad(checker Checker) {
+	executor := newQueryExecutor(q.queryExecutorOptions)
+
+	query := new(strings.Builder)
+	for i := 0; ; i++ {
+		func() {
+			if i > 0 {
+				time.Sleep(q.Sleep)
+			}
+
+			curHostnames := checker.GetHostNames()
+			if len(curHostnames) == 0 {
+				return
+			}
+			host := curHostnames[rand.Intn(len(curHostnames))]
+
+			truth, ok := q.generator.GroundTruth(host)
+			if !ok {
+				return
+			}
+
+			selector := fmt.Sprintf("hostname=\"%s\"", host)
+			tmpl := histogramQueryTemplates[rand.Intn(len(histogramQueryTemplates))]
+
+			query.Reset()
+			mustWriteString(query, fmt.Sprintf(tmpl.query, "{"+selector+"}"))
+
+			res, err := executor.fanoutQuery(query, true, q.LoadRange, q.LoadStep, nil)
+			if err != nil {
+				q.Logger.Error("histogram fanout failed", zap.Error(err), zap.String("template", tmpl.name))
+				return
+			}
+
+			for _, data := range res {
+				q.validateHistogramQuery(truth, data)
+			}
+		}()
+	}
+}
+
+// validateHistogramQuery parses a `resultType: "matrix"` response whose
+// values are native histogram objects and compares bucket counts and
+// sum/count against the generator's ground truth for the host.
+func (q *histogramQueryExecutor) validateHistogramQuery(truth histogramGroundTruth, data []byte) bool {
+	type histogramMatrix struct {
+		Histograms []PromQueryHistogramPair `json:"histograms"`
+	}
+	type histogramResult struct {
+		Data struct {
+			Result []histogramMatrix `json:"result"`
+		} `json:"data"`
+	}
+
+	res := histogramResult{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		q.Logger.Error("unable to unmarshal native histogram query result", zap.Error(err))
+		return false
+	}
+
+	if len(res.Data.Result) == 0 {
+		q.Logger.Warn("no histogram series returned from query. There may be a slight delay in ingestion")
+		return false
+	}
+
+	matched := false
+	for _, series := range res.Data.Result {
+		for _, pair := range series.Histograms {
+			count, err := strconv.ParseFloat(pair.Histogram.Count, 64)
+			if err != nil {
+				continue
+			}
+			sum, err := strconv.ParseFloat(pair.Histogram.Sum, 64)
+			if err != nil {
+				continue
+			}
+
+			if uint64(count) != truth.count || !floatsNearlyEqual(sum, truth.sum) {
+				continue
+			}
+
+			if !q.compareBuckets(truth, pair.Histogram.Buckets) {
+				continue
+			}
+
+			matched = true
+		}
+	}
+
+	if !matched {
+		q.Logger.Error("no native histogram samples matched ground truth")
+	}
+
+	return matched
+}
+
+// compareBuckets checks that the non-zero positive buckets the
+// generator recorded in truth appear, in the same order, with the same
+// counts and the same schema-derived upper boundary, in a decoded
+// native histogram's buckets array.
+func (q *histogramQueryExecutor) compareBuckets(truth histogramGroundTruth, buckets [][]interface{}) bool {
+	var expectedCounts, expectedUpperBounds []float64
+	for i, c := range truth.positiveCounts {
+		if c <= 0 {
+			continue
+		}
+		expectedCounts = append(expectedCounts, c)
+		expectedUpperBounds = append(expectedUpperBounds, nativeHistogramBucketUpperBound(i))
+	}
+
+	if len(buckets) != len(expectedCounts) {
+		q.Logger.Error("native histogram bucket count mismatch",
+			zap.Int("expected_buckets", len(expectedCounts)),
+			zap.Int("actual_buckets", len(buckets)))
+		return false
+	}
+
+	ok := true
+	for i, bucket := range buckets {
+		if len(bucket) != 4 {
+			q.Logger.Error("malformed native histogram bucket", zap.Int("bucket", i))
+			ok = false
+			continue
+		}
+
+		rightEdgeStr, _ := bucket[2].(string)
+		countStr, _ := bucket[3].(string)
+
+		rightEdge, err := strconv.ParseFloat(rightEdgeStr, 64)
+		if err != nil {
+			q.Logger.Error("unable to parse native histogram bucket boundary", zap.Int("bucket", i), zap.Error(err))
+			ok = false
+			continue
+		}
+
+		count, err := strconv.ParseFloat(countStr, 64)
+		if err != nil {
+			q.Logger.Error("unable to parse native histogram bucket count", zap.Int("bucket", i), zap.Error(err))
+			ok = false
+			continue
+		}
+
+		if !floatsNearlyEqual(count, expectedCounts[i]) {
+			q.Logger.Error("native histogram bucket count mismatch",
+				zap.Int("bucket", i),
+				zap.Float64("expected", expectedCounts[i]),
+				zap.Float64("actual", count))
+			ok = false
+		}
+
+		if !floatsWithinRelativeTolerance(rightEdge, expectedUpperBounds[i]) {
+			q.Logger.Error("native histogram bucket boundary mismatch",
+				zap.Int("bucket", i),
+				zap.Float64("expected_upper_bound", expectedUpperBounds[i]),
+				zap.Float64("actual_upper_bound", rightEdge))
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// nativeHistogramBucketUpperBound returns the upper bucket boundary for
+// positive bucket index under nativeHistogramSchema: bucket i covers
+// (2^(i/2^schema), 2^((i+1)/2^schema)].
+func nativeHistogramBucketUpperBound(index int) float64 {
+	return math.Pow(2, float64(index+1)/math.Pow(2, float64(nativeHistogramSchema)))
+}
+
+func floatsNearlyEqual(a, b float64) bool {
+	const epsilon = 1e-6
+	diff := a - b
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= epsilon
+}
+
+// floatsWithinRelativeTolerance reports whether a and b are within a
+// small relative tolerance of each other, used for boundary comparisons
+// where absolute magnitudes vary widely across buckets.
+func floatsWithinRelativeTolerance(a, b float64) bool {
+	const relEpsilon = 1e-6
+	if b == 0 {
+		return floatsNearlyEqual(a, b)
+	}
+	diff := (a - b) / b
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= relEpsilon
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+
+	xerrors "github.com/m3db/m3/src/x/errors"
+	"go.uber.org/zap"
+)
+
+// histogramWriteExecutorOptions configures a histogramWriteExecutor.
+type histogramWriteExecutorOptions struct {
+	// WriteURLs are the remote_write endpoints to emit native histogram
+	// samples to, e.g. "http://host:9090/api/v1/write".
+	WriteURLs []string
+	// WriteInterval is how often a new histogram sample is generated and
+	// written for every currently known host.
+	WriteInterval time.Duration
+	Headers       map[string]string
+	Logger        *zap.Logger
+}
+
+// histogramWriteExecutor periodically generates a native (sparse)
+// histogram sample for every host the Checker knows about and writes
+// it to the configured remote_write endpoints as a snappy-compressed
+// protobuf WriteRequest, the write-side counterpart to
+// histogramQueryExecutor's query-side validation.
+type histogramWriteExecutor struct {
+	histogramWriteExecutorOptions
+	generator *nativeHistogramGenerator
+	client    *http.Client
+}
+
+func newHistogramWriteExecutor(
+	opts histogramWriteExecutorOptions,
+	generator *nativeHistogramGenerator,
+) *histogramWriteExecutor {
+	return &histogramWriteExecutor{
+		histogramWriteExecutorOptions: opts,
+		generator:                     generator,
+		client:                        http.DefaultClient,
+	}
+}
+
+// Run starts the write loop if any write endpoints are configured.
+func (w *histogramWriteExecutor) Run(checker Checker) {
+	if len(w.WriteURLs) == 0 {
+		return
+	}
+
+	w.Logger.Info("native histogram write load configured",
+		zap.Strings("urls", w.WriteURLs))
+	go w.writeLoop(checker)
+}
+
+func (w *histogramWriteExecutor) writeLoop(checker Checker) {
+	interval := w.WriteInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	for i := 0; ; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+
+		hosts := checker.GetHostNames()
+		if len(hosts) == 0 {
+			continue
+		}
+
+		now := time.Now()
+		req := &prompb.WriteRequest{
+			Timeseries: make([]prompb.TimeSeries, 0, len(hosts)),
+		}
+		for _, host := range hosts {
+			histogram := w.generator.Generate(host, now)
+			req.Timeseries = append(req.Timeseries, prompb.TimeSeries{
+				Labels: []prompb.Label{
+					{Name: "__name__", Value: "promremotebench_native_histogram"},
+					{Name: "hostname", Value: host},
+				},
+				Histograms: []prompb.Histogram{histogram},
+			})
+		}
+
+		if err := w.write(req); err != nil {
+			w.Logger.Error("failed to write native histograms", zap.Error(err))
+		}
+	}
+}
+
+func (w *histogramWriteExecutor) write(req *prompb.WriteRequest) error {
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal WriteRequest: %v", err)
+	}
+	compressed := snappy.Encode(nil, data)
+
+	var multiErr xerrors.MultiError
+	for _, url := range w.WriteURLs {
+		multiErr = multiErr.Add(w.writeOne(url, compressed))
+	}
+
+	return multiErr.FinalError()
+}
+
+func (w *histogramWriteExecutor) writeOne(url string, body []byte) error {
+	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request error: %v", err)
+	}
+
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for k, v := range w.Headers {
+		httpReq.Header.Set(k, v)
+	}
+
+	resp, err := w.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("write to %s returned non-2XX status code: %d", url, resp.StatusCode)
+	}
+
+	return nil
+}
@@ -21,7 +21,6 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -31,6 +30,7 @@ import (
 	"math/rand"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -65,6 +65,98 @@ type queryExecutorOptions struct {
 	Debug         bool
 	DebugLength   int
 	Logger        *zap.Logger
+
+	// RemoteReadURLs, if set, additionally fans out remote_read
+	// requests to these endpoints and cross-validates the decoded
+	// results against the checker, alongside the HTTP PromQL load.
+	RemoteReadURLs []string
+
+	// Tenants, if set, causes alertLoad and accuracyCheck to weight-shuffle
+	// across the listed tenants, injecting the tenant's header on every
+	// request and periodically checking that one tenant's header cannot
+	// read back another tenant's series.
+	Tenants []Tenant
+
+	// HistogramGenerator, if set, queries the native histogram series the
+	// write path emitted through the same generator with a raw selector
+	// (no histogram_quantile, histogram_sum or rate templates are issued),
+	// cross-validating results against its recorded ground truth.
+	// HistogramWriteURLs must also be
+	// set for the generator to ever produce ground truth to query.
+	HistogramGenerator     *nativeHistogramGenerator
+	HistogramWriteURLs     []string
+	HistogramWriteInterval time.Duration
+
+	// ToleranceAbs and ToleranceRel (populated from --query.tolerance-abs
+	// and --query.tolerance-rel) allow fanoutQuery to accept near-equal
+	// floats produced by different query engines instead of requiring
+	// byte-identical responses.
+	ToleranceAbs float64
+	ToleranceRel float64
+
+	// MismatchReportWriter, if set, receives one JSON line per mismatching
+	// fanoutQuery comparison describing the series and per-timestamp
+	// deltas that caused the mismatch.
+	MismatchReportWriter io.Writer
+
+	// AdaptiveConcurrency, if set, replaces the fixed alertLoad goroutine
+	// pool with a rate-limited, EWMA-scaled shard pool per URL instead of
+	// running alertLoad directly.
+	AdaptiveConcurrency *adaptiveConcurrencyOptions
+
+	// WorkloadProfiles, if set, causes alertLoad to randomly select
+	// among them on every round instead of always issuing the default
+	// hostname alternation query.
+	WorkloadProfiles []WorkloadProfile
+
+	// GRPC, if set, additionally fans queries out to Thanos-style
+	// StoreAPI/Query gRPC endpoints alongside the HTTP PromQL load. Its
+	// embedded queryExecutorOptions is overwritten with this one's at
+	// Run time, so only the gRPC-specific fields need to be populated.
+	GRPC *grpcQueryExecutorOptions
+}
+
+// Tenant describes a single tenant to route query load through in a
+// multi-tenant backend, e.g. Thanos's "THANOS-TENANT" or Cortex's
+// "X-Scope-OrgID".
+type Tenant struct {
+	ID             string
+	Header         string
+	LabelOverrides map[string]string
+	// Weight controls how often this tenant is picked relative to the
+	// others; a weight <= 0 is treated as 1.
+	Weight int
+}
+
+// pickTenant weight-shuffles across the configured tenants, returning
+// nil if none are configured.
+func (q *queryExecutor) pickTenant() *Tenant {
+	if len(q.Tenants) == 0 {
+		return nil
+	}
+
+	total := 0
+	for _, t := range q.Tenants {
+		total += tenantWeight(t)
+	}
+
+	r := rand.Intn(total)
+	for i := range q.Tenants {
+		w := tenantWeight(q.Tenants[i])
+		if r < w {
+			return &q.Tenants[i]
+		}
+		r -= w
+	}
+
+	return &q.Tenants[len(q.Tenants)-1]
+}
+
+func tenantWeight(t Tenant) int {
+	if t.Weight <= 0 {
+		return 1
+	}
+	return t.Weight
 }
 
 func newQueryExecutor(opts queryExecutorOptions) *queryExecutor {
@@ -77,25 +169,52 @@ func newQueryExecutor(opts queryExecutorOptions) *queryExecutor {
 func (q *queryExecutor) Run(checker Checker) {
 	q.Logger.Info("query load configured",
 		zap.Int("concurrency", q.Concurrency))
-	for i := 0; i < q.Concurrency; i++ {
-		go q.alertLoad(checker)
+
+	if q.AdaptiveConcurrency != nil {
+		newAdaptiveQueryLoad(q, *q.AdaptiveConcurrency).Run(checker)
+	} else {
+		for i := 0; i < q.Concurrency; i++ {
+			go q.alertLoad(checker)
+		}
 	}
 
 	go q.accuracyCheck(checker)
+
+	if len(q.RemoteReadURLs) > 0 {
+		newRemoteReadQueryExecutor(q.queryExecutorOptions, q.RemoteReadURLs).Run(checker)
+	}
+
+	if len(q.Tenants) > 1 {
+		go q.isolationCheck(checker)
+	}
+
+	if q.GRPC != nil {
+		grpcOpts := *q.GRPC
+		grpcOpts.queryExecutorOptions = q.queryExecutorOptions
+
+		grpcExecutor, err := newGRPCQueryExecutor(grpcOpts)
+		if err != nil {
+			q.Logger.Error("failed to set up grpc query executor", zap.Error(err))
+		} else {
+			grpcExecutor.Run(checker)
+		}
+	}
+
+	if q.HistogramGenerator != nil {
+		newHistogramWriteExecutor(histogramWriteExecutorOptions{
+			WriteURLs:     q.HistogramWriteURLs,
+			WriteInterval: q.HistogramWriteInterval,
+			Headers:       q.Headers,
+			Logger:        q.Logger,
+		}, q.HistogramGenerator).Run(checker)
+
+		newHistogramQueryExecutor(q.queryExecutorOptions, q.HistogramGenerator).Run(checker)
+	}
 }
 
 // accuracyCheck checks the accuracy of data for one
 // host at a time.
 func (q *queryExecutor) accuracyCheck(checker Checker) {
-	type label struct {
-		name  string
-		value string
-	}
-	labels := make([]label, 0, len(q.Labels))
-	for k, v := range q.Labels {
-		labels = append(labels, label{name: k, value: v})
-	}
-
 	query := new(strings.Builder)
 	for i := 0; ; i++ {
 		func() {
@@ -104,6 +223,9 @@ func (q *queryExecutor) accuracyCheck(checker Checker) {
 				time.Sleep(q.Sleep)
 			}
 
+			tenant := q.pickTenant()
+			labels := q.labelsFor(tenant)
+
 			query.Reset()
 			if q.Aggregation != "" {
 				mustWriteString(query, q.Aggregation)
@@ -152,7 +274,7 @@ func (q *queryExecutor) accuracyCheck(checker Checker) {
 				mustWriteString(query, "})")
 			}
 
-			res, err := q.fanoutQuery(query, true, q.AccuracyRange, q.AccuracyStep)
+			res, err := q.fanoutQuery(query, true, q.AccuracyRange, q.AccuracyStep, tenant)
 			if len(res) == 0 {
 				q.Logger.Error("invalid response for accuracy query")
 			} else if err != nil {
@@ -166,7 +288,41 @@ func (q *queryExecutor) accuracyCheck(checker Checker) {
 	}
 }
 
-func (q *queryExecutor) alertLoad(checker Checker) {
+type label struct {
+	name  string
+	value string
+}
+
+// labelsFor builds the common label set for a query, applying the
+// tenant's label overrides (if any) on top of the globally configured
+// labels.
+func (q *queryExecutor) labelsFor(tenant *Tenant) []label {
+	merged := make(map[string]string, len(q.Labels))
+	for k, v := range q.Labels {
+		merged[k] = v
+	}
+	if tenant != nil {
+		for k, v := range tenant.LabelOverrides {
+			merged[k] = v
+		}
+	}
+
+	labels := make([]label, 0, len(merged))
+	for k, v := range merged {
+		labels = append(labels, label{name: k, value: v})
+	}
+	return labels
+}
+
+// workloadProfiles returns the configured WorkloadProfiles, or a
+// single profile reproducing the original hardcoded hostname
+// alternation if none were configured, so alertLoad always has at
+// least one profile to pick from.
+func (q *queryExecutor) workloadProfiles() []WorkloadProfile {
+	if len(q.WorkloadProfiles) > 0 {
+		return q.WorkloadProfiles
+	}
+
 	// Select number of write hosts to select metrics from.
 	numHosts := int(math.Ceil(float64(q.NumSeries) / 101.0))
 	if numHosts < 1 {
@@ -180,16 +336,18 @@ func (q *queryExecutor) alertLoad(checker Checker) {
 			zap.Int("num-write-hosts", q.NumWriteHosts))
 	}
 
-	type label struct {
-		name  string
-		value string
-	}
-	labels := make([]label, 0, len(q.Labels))
-	for k, v := range q.Labels {
-		labels = append(labels, label{name: k, value: v})
+	return []WorkloadProfile{
+		&hostnameRegexSelector{
+			NumHosts:    numHosts,
+			Aggregation: q.Aggregation,
+			LoadRange:   q.LoadRange,
+			LoadStep:    q.LoadStep,
+		},
 	}
+}
 
-	pickedHosts := make(map[string]struct{})
+func (q *queryExecutor) alertLoad(checker Checker) {
+	profiles := q.workloadProfiles()
 
 	query := new(strings.Builder)
 	for i := 0; ; i++ {
@@ -199,10 +357,11 @@ func (q *queryExecutor) alertLoad(checker Checker) {
 				time.Sleep(q.Sleep)
 			}
 
-			query.Reset()
-			if q.Aggregation != "" {
-				mustWriteString(query, q.Aggregation)
-				mustWriteString(query, "({")
+			tenant := q.pickTenant()
+			labels := q.labelsFor(tenant)
+			labelMap := make(map[string]string, len(labels))
+			for _, l := range labels {
+				labelMap[l.name] = l.value
 			}
 
 			curHostnames := checker.GetHostNames()
@@ -211,50 +370,49 @@ func (q *queryExecutor) alertLoad(checker Checker) {
 				return
 			}
 
-			// Now we pick a few hosts to select metrics from, each should return 101 metrics.
-			for k := range pickedHosts {
-				delete(pickedHosts, k) // Reuse pickedHosts
-			}
-			mustWriteString(query, "hostname=~\"(")
-			for j := 0; j < numHosts; j++ {
-				hostIndex := rand.Intn(len(curHostnames))
-				if _, ok := pickedHosts[curHostnames[hostIndex]]; ok {
-					j-- // Try again.
-					continue
-				}
-				pickedHosts[curHostnames[hostIndex]] = struct{}{}
-				mustWriteString(query, curHostnames[hostIndex])
-				if j < numHosts-1 {
-					mustWriteString(query, "|")
-				}
-			}
-			mustWriteString(query, ")\"")
+			profile := profiles[rand.Intn(len(profiles))]
+			queryStr, shape, queryRange, queryStep := profile.BuildQuery(curHostnames, labelMap)
 
-			// Write the common labels.
-			for j := 0; j < len(labels); j++ {
-				mustWriteString(query, ",")
+			query.Reset()
+			mustWriteString(query, queryStr)
 
-				l := labels[j]
-				mustWriteString(query, l.name)
-				mustWriteString(query, "=\"")
-				mustWriteString(query, l.value)
-				mustWriteString(query, "\"")
+			res, err := q.fanoutQuery(query, shape.ExpectedSeries > 0, queryRange, queryStep, tenant)
+			if err != nil {
+				q.Logger.Error("workload profile query failed",
+					zap.String("profile", profile.Name()),
+					zap.Error(err))
+				return
 			}
 
-			if q.Aggregation != "" {
-				mustWriteString(query, "})")
+			if shape.ExpectedSeries > 0 {
+				for _, data := range res {
+					if !resultHasSeriesCount(data, shape.ExpectedSeries) {
+						q.Logger.Error("workload profile result shape mismatch",
+							zap.String("profile", profile.Name()),
+							zap.Int("expected_series", shape.ExpectedSeries))
+					}
+				}
 			}
-
-			q.fanoutQuery(query, false, q.LoadRange, q.LoadStep)
 		}()
 	}
 }
 
+// resultHasSeriesCount reports whether a raw PromQL query response
+// contains exactly expected series.
+func resultHasSeriesCount(data []byte, expected int) bool {
+	res := PromQueryResult{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return false
+	}
+	return len(res.Data.Result) == expected
+}
+
 func (q *queryExecutor) fanoutQuery(
 	query *strings.Builder,
 	retResult bool,
 	queryRange time.Duration,
 	queryStep time.Duration,
+	tenant *Tenant,
 ) ([][]byte, error) {
 	now := time.Now()
 	values := make(url.Values)
@@ -270,8 +428,8 @@ func (q *queryExecutor) fanoutQuery(
 		qs       = values.Encode()
 	)
 
-	results := make([][]byte, 0, len(q.URLs))
-	for _, url := range q.URLs {
+	results := make([][]byte, len(q.URLs))
+	for idx, url := range q.URLs {
 		wg.Add(1)
 		reqURL := fmt.Sprintf("%s?%s", url, qs)
 
@@ -281,13 +439,14 @@ func (q *queryExecutor) fanoutQuery(
 				zap.Any("values", values))
 		}
 
-		go func() {
-			res, err := q.executeQuery(reqURL, retResult)
+		go func(idx int) {
+			defer wg.Done()
+			res, err := q.executeQuery(reqURL, retResult, tenant)
 			mu.Lock()
 			multiErr = multiErr.Add(err)
-			results = append(results, res)
+			results[idx] = res
 			mu.Unlock()
-		}()
+		}(idx)
 	}
 
 	wg.Wait()
@@ -302,13 +461,25 @@ func (q *queryExecutor) fanoutQuery(
 		return results, nil
 	}
 
-	firstResult := results[0]
-	for i, res := range results[1:] {
-		if bytes.Equal(res, firstResult) {
+	mismatched := false
+	for i := 1; i < len(results); i++ {
+		report, equal := q.diffQueryResults(query.String(), results[0], results[i])
+		if equal {
 			continue
 		}
 
-		q.Logger.Error("mismatch in returned data", zap.Int("index", i))
+		mismatched = true
+		report.LeftURL = q.URLs[0]
+		report.RightURL = q.URLs[i]
+		q.writeMismatchReport(report)
+		q.Logger.Error("mismatch in returned data",
+			zap.Int("index", i),
+			zap.Int("missing_left", len(report.MissingLeft)),
+			zap.Int("missing_right", len(report.MissingRight)),
+			zap.Int("deltas", len(report.Deltas)))
+	}
+
+	if mismatched {
 		return nil, errors.New("mismatch in returned data")
 	}
 
@@ -318,6 +489,7 @@ func (q *queryExecutor) fanoutQuery(
 func (q *queryExecutor) executeQuery(
 	reqURL string,
 	retResult bool,
+	tenant *Tenant,
 ) ([]byte, error) {
 	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
 	if err != nil {
@@ -330,6 +502,10 @@ func (q *queryExecutor) executeQuery(
 		}
 	}
 
+	if tenant != nil {
+		req.Header.Set(tenant.Header, tenant.ID)
+	}
+
 	resp, err := q.client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %v", err)
@@ -370,6 +546,97 @@ func (q *queryExecutor) executeQuery(
 	return nil, nil
 }
 
+// isolationCheck periodically issues the same series query once under
+// tenant A's header and once under tenant B's header, and asserts that
+// tenant B's response does not contain A's series: a series with the
+// same label set AND the same sample values as A's response, which
+// would mean B's backend echoed A's exact data back rather than B's
+// own (possibly coincidentally same-named) series or nothing at all.
+// This mirrors how a leaky multi-tenant backend would cross-contaminate
+// results between tenants.
+func (q *queryExecutor) isolationCheck(checker Checker) {
+	query := new(strings.Builder)
+	for i := 0; ; i++ {
+		func() {
+			if i > 0 {
+				time.Sleep(q.Sleep)
+			}
+
+			tenantA := &q.Tenants[rand.Intn(len(q.Tenants))]
+			tenantB := &q.Tenants[rand.Intn(len(q.Tenants))]
+			if tenantA.ID == tenantB.ID {
+				return
+			}
+
+			curHostnames := checker.GetHostNames()
+			if len(curHostnames) == 0 {
+				return
+			}
+			host := curHostnames[rand.Intn(len(curHostnames))]
+
+			query.Reset()
+			mustWriteString(query, "hostname=\""+host+"\"")
+
+			resA, err := q.fanoutQuery(query, true, q.AccuracyRange, q.AccuracyStep, tenantA)
+			if err != nil || len(resA) == 0 {
+				return
+			}
+
+			query.Reset()
+			mustWriteString(query, "hostname=\""+host+"\"")
+
+			resB, err := q.fanoutQuery(query, true, q.AccuracyRange, q.AccuracyStep, tenantB)
+			if err != nil {
+				return
+			}
+
+			for _, dataA := range resA {
+				for _, dataB := range resB {
+					if series, leaked := q.leakedSeries(dataA, dataB); leaked {
+						q.Logger.Error("tenant isolation violation: tenant saw another tenant's series",
+							zap.String("tenant", tenantB.ID),
+							zap.String("leaked_from_tenant", tenantA.ID),
+							zap.String("hostname", host),
+							zap.String("series", series))
+					}
+				}
+			}
+		}()
+	}
+}
+
+// leakedSeries reports whether any series in dataB has both the same
+// label set and the same sample values (within the configured
+// tolerance) as a series in dataA, which is only possible if dataB's
+// backend returned dataA's own data.
+func (q *queryExecutor) leakedSeries(dataA, dataB []byte) (string, bool) {
+	var resA, resB PromQueryResult
+	if err := json.Unmarshal(dataA, &resA); err != nil {
+		return "", false
+	}
+	if err := json.Unmarshal(dataB, &resB); err != nil {
+		return "", false
+	}
+
+	seriesA := canonicalizeSeries(resA.Data.Result)
+	seriesB := canonicalizeSeries(resB.Data.Result)
+
+	for key, matrixA := range seriesA {
+		matrixB, ok := seriesB[key]
+		if !ok || len(matrixA.Values) == 0 || len(matrixB.Values) == 0 {
+			// Tenant B has no series with this identity at all, which is
+			// the expected, isolated outcome - not a leak.
+			continue
+		}
+
+		if len(q.compareValues(key, matrixA.Values, matrixB.Values)) == 0 {
+			return key, true
+		}
+	}
+
+	return "", false
+}
+
 // PromQueryResult is a prom query result.
 type PromQueryResult struct {
 	Status string        `json:"status"`
@@ -385,9 +652,167 @@ type PromQueryData struct {
 
 // PromQueryMatrix is a prom query matrix.
 type PromQueryMatrix struct {
+	Metric model.Metric       `json:"metric"`
 	Values []model.SamplePair `json:"values"`
 }
 
+// QueryMismatchReport is a machine-readable (JSON lines) description of
+// why two endpoints' responses to the same query diverged: series
+// present on only one side, plus per-series/per-timestamp deltas that
+// exceeded the configured float tolerance.
+type QueryMismatchReport struct {
+	Query        string               `json:"query"`
+	LeftURL      string               `json:"left_url"`
+	RightURL     string               `json:"right_url"`
+	MissingLeft  []string             `json:"missing_left,omitempty"`
+	MissingRight []string             `json:"missing_right,omitempty"`
+	Deltas       []QueryMismatchDelta `json:"deltas,omitempty"`
+}
+
+// QueryMismatchDelta describes a single sample that differed by more
+// than the configured tolerance between two endpoints' responses.
+type QueryMismatchDelta struct {
+	Series    string  `json:"series"`
+	Timestamp int64   `json:"timestamp"`
+	Left      float64 `json:"left"`
+	Right     float64 `json:"right"`
+	Delta     float64 `json:"delta"`
+}
+
+// diffQueryResults canonicalizes and compares two raw PromQL query
+// responses, returning a populated report and false if they diverge by
+// more than the configured tolerance.
+func (q *queryExecutor) diffQueryResults(query string, left, right []byte) (QueryMismatchReport, bool) {
+	report := QueryMismatchReport{Query: query}
+
+	var leftRes, rightRes PromQueryResult
+	if err := json.Unmarshal(left, &leftRes); err != nil {
+		q.Logger.Error("unable to unmarshal left side of fanout comparison", zap.Error(err))
+		return report, false
+	}
+	if err := json.Unmarshal(right, &rightRes); err != nil {
+		q.Logger.Error("unable to unmarshal right side of fanout comparison", zap.Error(err))
+		return report, false
+	}
+
+	leftSeries := canonicalizeSeries(leftRes.Data.Result)
+	rightSeries := canonicalizeSeries(rightRes.Data.Result)
+
+	equal := true
+	for key, leftMatrix := range leftSeries {
+		rightMatrix, ok := rightSeries[key]
+		if !ok {
+			report.MissingRight = append(report.MissingRight, key)
+			equal = false
+			continue
+		}
+
+		deltas := q.compareValues(key, leftMatrix.Values, rightMatrix.Values)
+		if len(deltas) > 0 {
+			report.Deltas = append(report.Deltas, deltas...)
+			equal = false
+		}
+	}
+
+	for key := range rightSeries {
+		if _, ok := leftSeries[key]; !ok {
+			report.MissingLeft = append(report.MissingLeft, key)
+			equal = false
+		}
+	}
+
+	return report, equal
+}
+
+// canonicalizeSeries indexes a query result's series by their label set
+// so comparisons are independent of the order endpoints returned them
+// in, and sorts each series' samples by timestamp.
+func canonicalizeSeries(matrix []PromQueryMatrix) map[string]PromQueryMatrix {
+	series := make(map[string]PromQueryMatrix, len(matrix))
+	for _, m := range matrix {
+		values := append([]model.SamplePair(nil), m.Values...)
+		sort.Slice(values, func(i, j int) bool {
+			return values[i].Timestamp < values[j].Timestamp
+		})
+		series[m.Metric.String()] = PromQueryMatrix{Metric: m.Metric, Values: values}
+	}
+	return series
+}
+
+// compareValues compares two canonicalized sample sequences for the
+// same series timestamp-by-timestamp, reporting any pair whose
+// difference exceeds the configured absolute/relative tolerance.
+//
+// This is a method on queryExecutorOptions rather than queryExecutor so
+// that every executor embedding queryExecutorOptions (HTTP PromQL,
+// remote_read, ...) shares the same canonicalize-then-compare logic
+// instead of reimplementing it.
+func (q *queryExecutorOptions) compareValues(series string, left, right []model.SamplePair) []QueryMismatchDelta {
+	var deltas []QueryMismatchDelta
+
+	n := len(left)
+	if len(right) < n {
+		n = len(right)
+	}
+
+	for i := 0; i < n; i++ {
+		l, r := float64(left[i].Value), float64(right[i].Value)
+		if q.withinTolerance(l, r) {
+			continue
+		}
+
+		deltas = append(deltas, QueryMismatchDelta{
+			Series:    series,
+			Timestamp: int64(left[i].Timestamp),
+			Left:      l,
+			Right:     r,
+			Delta:     l - r,
+		})
+	}
+
+	if len(left) != len(right) {
+		deltas = append(deltas, QueryMismatchDelta{
+			Series: series,
+			Delta:  float64(len(left) - len(right)),
+		})
+	}
+
+	return deltas
+}
+
+// withinTolerance reports whether l and r are close enough to be
+// considered equal given the configured absolute and relative
+// tolerances (atol + rtol*|r|), accepting tiny floating-point
+// differences that legitimately occur across query engines.
+func (q *queryExecutorOptions) withinTolerance(l, r float64) bool {
+	diff := l - r
+	if diff < 0 {
+		diff = -diff
+	}
+
+	allowed := q.ToleranceAbs + q.ToleranceRel*math.Abs(r)
+	return diff <= allowed
+}
+
+// writeMismatchReport appends report as a single JSON line to
+// MismatchReportWriter, if configured.
+func (q *queryExecutor) writeMismatchReport(report QueryMismatchReport) {
+	if q.MismatchReportWriter == nil {
+		return
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		q.Logger.Error("failed to marshal mismatch report", zap.Error(err))
+		return
+	}
+
+	data = append(data, '\n')
+	if _, err := q.MismatchReportWriter.Write(data); err != nil {
+		q.Logger.Error("failed to write mismatch report", zap.Error(err))
+	}
+}
+
 func (q *queryExecutor) validateQuery(dps Datapoints, data []byte) bool {
 	res := PromQueryResult{}
 	err := json.Unmarshal(data, &res)
@@ -0,0 +1,347 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+
+	xerrors "github.com/m3db/m3/src/x/errors"
+	"go.uber.org/zap"
+)
+
+// remoteReadQueryExecutor issues Prometheus remote_read requests in
+// parallel against a set of remote_read endpoints and cross-validates
+// the results the same way queryExecutor does for the HTTP PromQL path.
+type remoteReadQueryExecutor struct {
+	queryExecutorOptions
+	client *http.Client
+
+	// RemoteReadURLs are the remote_read endpoints to fan out to, e.g.
+	// "http://host:9090/api/v1/read".
+	RemoteReadURLs []string
+}
+
+func newRemoteReadQueryExecutor(
+	opts queryExecutorOptions,
+	remoteReadURLs []string,
+) *remoteReadQueryExecutor {
+	return &remoteReadQueryExecutor{
+		queryExecutorOptions: opts,
+		client:               http.DefaultClient,
+		RemoteReadURLs:        remoteReadURLs,
+	}
+}
+
+// Run starts the remote_read load and accuracy goroutines.
+func (q *remoteReadQueryExecutor) Run(checker Checker) {
+	if len(q.RemoteReadURLs) == 0 {
+		return
+	}
+
+	q.Logger.Info("remote_read load configured",
+		zap.Int("concurrency", q.Concurrency),
+		zap.Strings("urls", q.RemoteReadURLs))
+	for i := 0; i < q.Concurrency; i++ {
+		go q.remoteReadLoad(checker)
+	}
+}
+
+// remoteReadLoad periodically selects a host's series, builds a
+// remote_read ReadRequest from its labels and fans it out to every
+// configured remote_read endpoint, checking the decoded results both
+// against each other and against the in-memory Checker datapoints.
+func (q *remoteReadQueryExecutor) remoteReadLoad(checker Checker) {
+	for i := 0; ; i++ {
+		func() {
+			if i > 0 {
+				time.Sleep(q.Sleep)
+			}
+
+			curHostnames := checker.GetHostNames()
+			if len(curHostnames) == 0 {
+				q.Logger.Error("no hosts returned in the checker, skipping remote_read round")
+				return
+			}
+
+			host := curHostnames[rand.Intn(len(curHostnames))]
+			dps := checker.GetDatapoints(host)
+			if len(dps) == 0 {
+				return
+			}
+
+			matchers := q.matchersFor(host)
+			now := time.Now()
+			req := &prompb.ReadRequest{
+				Queries: []*prompb.Query{
+					{
+						StartTimestampMs: now.Add(-1 * q.LoadRange).Unix() * 1000,
+						EndTimestampMs:   now.Unix() * 1000,
+						Matchers:         matchers,
+					},
+				},
+			}
+
+			results, err := q.fanoutRemoteRead(req)
+			if err != nil {
+				q.Logger.Error("remote_read fanout failed", zap.Error(err))
+				return
+			}
+
+			for _, result := range results {
+				q.validateRemoteRead(dps, result)
+			}
+		}()
+	}
+}
+
+// matchersFor builds the prompb label matchers selecting the series
+// written for a single host, mirroring the query construction used by
+// accuracyCheck for the HTTP PromQL path.
+func (q *remoteReadQueryExecutor) matchersFor(host string) []*prompb.LabelMatcher {
+	matchers := make([]*prompb.LabelMatcher, 0, len(q.Labels)+1)
+	matchers = append(matchers, &prompb.LabelMatcher{
+		Type:  prompb.LabelMatcher_EQ,
+		Name:  "hostname",
+		Value: host,
+	})
+
+	for k, v := range q.Labels {
+		matchers = append(matchers, &prompb.LabelMatcher{
+			Type:  prompb.LabelMatcher_EQ,
+			Name:  k,
+			Value: v,
+		})
+	}
+
+	return matchers
+}
+
+// fanoutRemoteRead issues req against every configured remote_read URL
+// in parallel, decodes each ReadResponse and checks that all endpoints
+// returned the same series (canonicalized by label identity, compared
+// within tolerance), the same mismatch semantics fanoutQuery applies to
+// the HTTP PromQL path.
+func (q *remoteReadQueryExecutor) fanoutRemoteRead(
+	req *prompb.ReadRequest,
+) ([]*prompb.QueryResult, error) {
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal ReadRequest: %v", err)
+	}
+	compressed := snappy.Encode(nil, data)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		multiErr xerrors.MultiError
+	)
+
+	results := make([]*prompb.QueryResult, 0, len(q.RemoteReadURLs))
+	for _, url := range q.RemoteReadURLs {
+		wg.Add(1)
+
+		go func(url string) {
+			defer wg.Done()
+
+			resp, err := q.executeRemoteRead(url, compressed)
+			mu.Lock()
+			defer mu.Unlock()
+			multiErr = multiErr.Add(err)
+			if resp != nil {
+				results = append(results, resp.Results...)
+			}
+		}(url)
+	}
+
+	wg.Wait()
+
+	if err := multiErr.FinalError(); err != nil {
+		q.Logger.Error("remote_read fanout error", zap.Error(err))
+		return nil, err
+	}
+
+	if len(results) < 2 {
+		return results, nil
+	}
+
+	first := results[0]
+	for i, res := range results[1:] {
+		if q.remoteReadResultsEqual(first, res) {
+			continue
+		}
+
+		q.Logger.Error("mismatch in returned remote_read data", zap.Int("index", i))
+		return nil, fmt.Errorf("mismatch in returned remote_read data")
+	}
+
+	return results, nil
+}
+
+func (q *remoteReadQueryExecutor) executeRemoteRead(
+	url string,
+	body []byte,
+) (*prompb.ReadResponse, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("create request error: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Read-Version", "0.1.0")
+	for k, v := range q.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		q.Logger.Warn("response from remote_read non-2XX status code",
+			zap.String("url", url),
+			zap.Int("code", resp.StatusCode))
+	}
+
+	compressed, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode snappy response: %v", err)
+	}
+
+	readResp := &prompb.ReadResponse{}
+	if err := proto.Unmarshal(data, readResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal ReadResponse: %v", err)
+	}
+
+	return readResp, nil
+}
+
+// remoteReadResultsEqual reports whether two QueryResults contain the
+// same set of series, canonicalized by label identity rather than
+// positional index (different backends may legitimately reorder
+// series) and compared sample-by-sample within the configured float
+// tolerance - the same canonicalize-then-compare approach
+// canonicalizeSeries/compareValues use for the HTTP PromQL path.
+func (q *remoteReadQueryExecutor) remoteReadResultsEqual(a, b *prompb.QueryResult) bool {
+	aSeries := canonicalizeSeries(promMatricesFromTimeseries(a.Timeseries))
+	bSeries := canonicalizeSeries(promMatricesFromTimeseries(b.Timeseries))
+
+	if len(aSeries) != len(bSeries) {
+		return false
+	}
+
+	for key, aMatrix := range aSeries {
+		bMatrix, ok := bSeries[key]
+		if !ok {
+			return false
+		}
+
+		if len(q.compareValues(key, aMatrix.Values, bMatrix.Values)) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// promMatricesFromTimeseries converts remote_read protobuf timeseries
+// into the PromQueryMatrix shape canonicalizeSeries expects, so
+// remote_read results can be canonicalized and compared the same way
+// as the JSON-decoded HTTP PromQL results.
+func promMatricesFromTimeseries(series []*prompb.TimeSeries) []PromQueryMatrix {
+	matrices := make([]PromQueryMatrix, 0, len(series))
+	for _, ts := range series {
+		metric := make(model.Metric, len(ts.Labels))
+		for _, l := range ts.Labels {
+			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		}
+
+		values := make([]model.SamplePair, 0, len(ts.Samples))
+		for _, s := range ts.Samples {
+			values = append(values, model.SamplePair{
+				Timestamp: model.Time(s.Timestamp),
+				Value:     model.SampleValue(s.Value),
+			})
+		}
+
+		matrices = append(matrices, PromQueryMatrix{Metric: metric, Values: values})
+	}
+
+	return matrices
+}
+
+// validateRemoteRead cross-validates the samples decoded from a
+// remote_read response against the in-memory Datapoints recorded by
+// the Checker, the same way validateQuery does for the HTTP path.
+func (q *remoteReadQueryExecutor) validateRemoteRead(dps Datapoints, result *prompb.QueryResult) bool {
+	if len(result.Timeseries) != 1 {
+		q.Logger.Error("expecting one series, but got "+strings.TrimSpace(fmt.Sprint(len(result.Timeseries))),
+			zap.Any("results", result.Timeseries))
+		return false
+	}
+
+	samples := result.Timeseries[0].Samples
+	if len(samples) == 0 {
+		q.Logger.Warn("no samples returned from remote_read. There may be a slight delay in ingestion")
+		return false
+	}
+
+	i, matches := 0, 0
+	for _, sample := range samples {
+		for i < len(dps) {
+			if sample.Value == dps[i].Value {
+				i++
+				matches++
+				break
+			}
+
+			i++
+		}
+
+		i = 0
+	}
+
+	if matches == 0 {
+		q.Logger.Error("no remote_read values matched at all.")
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// QueryResultShape describes what a WorkloadProfile's query is expected
+// to return. alertLoad checks only ExpectedSeries against the response;
+// it does not read Aggregated and does not run validateQuery's
+// per-sample comparison against raw Datapoints for any profile.
+type QueryResultShape struct {
+	// Aggregated is true when the query transforms samples (sum, topk,
+	// histogram_quantile, subqueries, ...) such that the response values
+	// can no longer be compared directly against raw Datapoints.
+	Aggregated bool
+	// ExpectedSeries is the number of series the query should return,
+	// or 0 if that count is data-dependent and shouldn't be checked.
+	ExpectedSeries int
+}
+
+// WorkloadProfile builds a PromQL query exercising a particular class
+// of backend subsystem (index scans, the query engine, the chunk
+// reader, ...) along with the shape of result it expects, so callers
+// can still cross-check what comes back.
+type WorkloadProfile interface {
+	// Name identifies the profile for logging.
+	Name() string
+	// BuildQuery returns a PromQL query selecting from hostnames (and
+	// the configured common labels), plus the shape of the expected
+	// result, and the query range/step to execute it over.
+	BuildQuery(hostnames []string, labels map[string]string) (query string, shape QueryResultShape, queryRange, queryStep time.Duration)
+}
+
+// hostnameRegexSelector is the original, default workload: an
+// alternation of a handful of hostnames plus the common labels.
+// queryExecutor.workloadProfiles uses it only when no WorkloadProfiles
+// are configured; configured profiles are picked uniformly at random.
+type hostnameRegexSelector struct {
+	NumHosts    int
+	Aggregation string
+	LoadRange   time.Duration
+	LoadStep    time.Duration
+}
+
+func (p *hostnameRegexSelector) Name() string { return "hostname_regex" }
+
+func (p *hostnameRegexSelector) BuildQuery(
+	hostnames []string,
+	labels map[string]string,
+) (string, QueryResultShape, time.Duration, time.Duration) {
+	picked := pickHosts(hostnames, p.NumHosts)
+	selector := "hostname=~\"(" + strings.Join(picked, "|") + ")\"" + labelSuffix(labels)
+	query := wrapAggregation(p.Aggregation, selector)
+
+	shape := QueryResultShape{Aggregated: p.Aggregation != "", ExpectedSeries: len(picked)}
+	if shape.Aggregated {
+		// A sum/avg/etc. over the selector collapses to a single series.
+		shape.ExpectedSeries = 1
+	}
+
+	return query, shape, p.LoadRange, p.LoadStep
+}
+
+// highCardinalitySelector matches on a random combination of common
+// labels (rather than a fixed hostname alternation) to force a
+// store-side index scan across many series.
+type highCardinalitySelector struct {
+	LoadRange time.Duration
+	LoadStep  time.Duration
+}
+
+func (p *highCardinalitySelector) Name() string { return "high_cardinality" }
+
+func (p *highCardinalitySelector) BuildQuery(
+	hostnames []string,
+	labels map[string]string,
+) (string, QueryResultShape, time.Duration, time.Duration) {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+
+	matchers := make([]string, 0, len(keys)+1)
+	matchers = append(matchers, "hostname=~\".+\"")
+	// Pick a random subset of the configured labels to match on with a
+	// regex, rather than requiring an exact match, to widen the scan.
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	for i := 0; i < len(keys) && i < 3; i++ {
+		matchers = append(matchers, fmt.Sprintf("%s=~\".*%s.*\"", keys[i], labels[keys[i]]))
+	}
+
+	query := fmt.Sprintf("{%s}", strings.Join(matchers, ","))
+	return query, QueryResultShape{}, p.LoadRange, p.LoadStep
+}
+
+// aggregationHeavy wraps the hostname selector in nested aggregation
+// operators to stress the query engine rather than the index or chunk
+// reader.
+type aggregationHeavy struct {
+	NumHosts  int
+	LoadRange time.Duration
+	LoadStep  time.Duration
+}
+
+func (p *aggregationHeavy) Name() string { return "aggregation_heavy" }
+
+func (p *aggregationHeavy) BuildQuery(
+	hostnames []string,
+	labels map[string]string,
+) (string, QueryResultShape, time.Duration, time.Duration) {
+	picked := pickHosts(hostnames, p.NumHosts)
+	selector := "hostname=~\"(" + strings.Join(picked, "|") + ")\"" + labelSuffix(labels)
+
+	templates := []string{
+		"sum by (hostname) ({%s})",
+		"topk(5, sum by (hostname) ({%s}))",
+		"histogram_quantile(0.99, sum by (le) (rate({%s}[5m])))",
+	}
+	template := templates[rand.Intn(len(templates))]
+	query := fmt.Sprintf(template, selector)
+
+	return query, QueryResultShape{Aggregated: true}, p.LoadRange, p.LoadStep
+}
+
+// subqueryHeavy wraps the hostname selector in a nested subquery to
+// stress the engine's subquery evaluation path.
+type subqueryHeavy struct {
+	NumHosts  int
+	LoadRange time.Duration
+	LoadStep  time.Duration
+}
+
+func (p *subqueryHeavy) Name() string { return "subquery_heavy" }
+
+func (p *subqueryHeavy) BuildQuery(
+	hostnames []string,
+	labels map[string]string,
+) (string, QueryResultShape, time.Duration, time.Duration) {
+	picked := pickHosts(hostnames, p.NumHosts)
+	selector := "hostname=~\"(" + strings.Join(picked, "|") + ")\"" + labelSuffix(labels)
+	// The subquery itself is range-vector/matrix-typed, which real
+	// /query_range endpoints reject as a top-level expression - wrap it
+	// in avg_over_time so the query we actually send is vector-typed.
+	query := fmt.Sprintf("avg_over_time(rate({%s}[5m])[1h:1m])", selector)
+
+	return query, QueryResultShape{Aggregated: true, ExpectedSeries: len(picked)}, p.LoadRange, p.LoadStep
+}
+
+// longRangeSparse requests hours-to-days of history at a large step,
+// stressing the chunk reader rather than the index or query engine.
+type longRangeSparse struct {
+	NumHosts int
+}
+
+func (p *longRangeSparse) Name() string { return "long_range_sparse" }
+
+func (p *longRangeSparse) BuildQuery(
+	hostnames []string,
+	labels map[string]string,
+) (string, QueryResultShape, time.Duration, time.Duration) {
+	picked := pickHosts(hostnames, p.NumHosts)
+	selector := "{" + "hostname=~\"(" + strings.Join(picked, "|") + ")\"" + labelSuffix(labels) + "}"
+
+	return selector, QueryResultShape{ExpectedSeries: len(picked)}, 48 * time.Hour, 15 * time.Minute
+}
+
+func pickHosts(hostnames []string, numHosts int) []string {
+	if numHosts > len(hostnames) {
+		numHosts = len(hostnames)
+	}
+
+	picked := make(map[string]struct{}, numHosts)
+	result := make([]string, 0, numHosts)
+	for len(result) < numHosts {
+		host := hostnames[rand.Intn(len(hostnames))]
+		if _, ok := picked[host]; ok {
+			continue
+		}
+		picked[host] = struct{}{}
+		result = append(result, host)
+	}
+
+	return result
+}
+
+func labelSuffix(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	b := new(strings.Builder)
+	for k, v := range labels {
+		fmt.Fprintf(b, ",%s=\"%s\"", k, v)
+	}
+	return b.String()
+}
+
+func wrapAggregation(aggregation, selector string) string {
+	if aggregation == "" {
+		return "{" + selector + "}"
+	}
+	return aggregation + "({" + selector + "})"
+}